@@ -2,29 +2,50 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base64"
 	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/net/html"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/alexflint/go-arg"
 	"github.com/alexflint/go-restructure"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
 )
 
 // regular expression pattern for email snippets from orangetheory
 //
 // example:
 //
-//   STUDIO WORKOUT SUMMARY Bothell, WA 06/13/2021 12‌:15 PM Tiffany 15 0 0 0 0 MINUTES / ZONE 55 CALORIES BURNED 0 SPLAT POINTS 75 AVG. HEART-RATE Peak HR: 80
+//	STUDIO WORKOUT SUMMARY Bothell, WA 06/13/2021 12‌:15 PM Tiffany 15 0 0 0 0 MINUTES / ZONE 55 CALORIES BURNED 0 SPLAT POINTS 75 AVG. HEART-RATE Peak HR: 80
 type snippet struct {
 	_                string `regexp:"STUDIO WORKOUT SUMMARY "`
 	City             string `regexp:"\\w+"`
@@ -68,6 +89,274 @@ type snippet struct {
 // compile a regular expression for the struct above
 var snippetParser = restructure.MustCompile(snippet{}, restructure.Options{})
 
+// workout is a parsed snippet together with the ID of the Gmail message it
+// was parsed from, which is used to derive a stable identity for the
+// workout across runs.
+type workout struct {
+	ID string
+	snippet
+}
+
+// startTime returns the workout's start time as parsed from its date and
+// time fields. Month, Day, Hour and Minute are matched from the email by a
+// \d+ regex and so may be a single digit (e.g. "6/3/2021 9:5 AM"), but the
+// "01/02/2006 03:04 PM" layout requires them zero-padded, so they are
+// zero-padded here before parsing.
+func (w workout) startTime() (time.Time, error) {
+	month, err := strconv.Atoi(w.Month)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid month %q: %v", w.Month, err)
+	}
+	day, err := strconv.Atoi(w.Day)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid day %q: %v", w.Day, err)
+	}
+	hour, err := strconv.Atoi(w.Hour)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid hour %q: %v", w.Hour, err)
+	}
+	minute, err := strconv.Atoi(w.Minute)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid minute %q: %v", w.Minute, err)
+	}
+
+	s := fmt.Sprintf("%02d/%02d/%s %02d:%02d %s", month, day, w.Year, hour, minute, w.AMPM)
+	return time.Parse("01/02/2006 03:04 PM", s)
+}
+
+// parseMessage extracts a snippet from a Gmail message, preferring the fast
+// path of matching snippetParser against the snippet field and falling back
+// to parseBody, a more tolerant parser over the full message body, when the
+// snippet does not match. This keeps a single snippet format change from
+// silently dropping workouts.
+func parseMessage(m *gmail.Message) (snippet, bool) {
+	var s snippet
+	if snippetParser.Find(&s, m.Snippet) {
+		return s, true
+	}
+	return parseBody(m)
+}
+
+// parseBody is the fallback parser used when the snippet regex does not
+// match, for example after OrangeTheory changes the formatting of the
+// snippet text. Messages are already fetched with format=full by
+// fetchMessageWithRetry, so no extra API call is needed here: this walks the
+// MIME tree already present on m.Payload to find the text/html (or
+// text/plain) part, strips the HTML down to plain text, and extracts the
+// same fields as the snippet regex using more tolerant, order-independent
+// per-field regexes against the email's table layout.
+func parseBody(m *gmail.Message) (snippet, bool) {
+	if m.Payload == nil {
+		return snippet{}, false
+	}
+
+	part := findMessagePart(m.Payload, "text/html")
+	if part == nil {
+		part = findMessagePart(m.Payload, "text/plain")
+	}
+	if part == nil {
+		return snippet{}, false
+	}
+
+	body, err := decodeMessagePartBody(part)
+	if err != nil {
+		return snippet{}, false
+	}
+
+	text := body
+	if part.MimeType == "text/html" {
+		if text, err = htmlToText(body); err != nil {
+			return snippet{}, false
+		}
+	}
+
+	return bodyFieldParser(text)
+}
+
+// findMessagePart searches a MIME tree depth-first for the first part whose
+// MimeType matches and which has a non-empty inline body.
+func findMessagePart(part *gmail.MessagePart, mimeType string) *gmail.MessagePart {
+	if part == nil {
+		return nil
+	}
+	if part.MimeType == mimeType && part.Body != nil && part.Body.Data != "" {
+		return part
+	}
+	for _, child := range part.Parts {
+		if found := findMessagePart(child, mimeType); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// decodeMessagePartBody decodes the base64url-encoded body of a MIME part.
+func decodeMessagePartBody(part *gmail.MessagePart) (string, error) {
+	if part.Body == nil || part.Body.Data == "" {
+		return "", fmt.Errorf("message part has no inline body data")
+	}
+	data, err := base64.URLEncoding.WithPadding(base64.NoPadding).DecodeString(part.Body.Data)
+	if err != nil {
+		return "", fmt.Errorf("error decoding message part body: %v", err)
+	}
+	return string(data), nil
+}
+
+// htmlToText strips tags from an HTML document, dropping script and style
+// content, and collapses whitespace so that table cells rendered without
+// separating whitespace in the markup don't run into each other.
+func htmlToText(doc string) (string, error) {
+	root, err := html.Parse(strings.NewReader(doc))
+	if err != nil {
+		return "", fmt.Errorf("error parsing HTML body: %v", err)
+	}
+
+	var sb strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && (n.Data == "script" || n.Data == "style") {
+			return
+		}
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+			sb.WriteByte(' ')
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(root)
+
+	return strings.Join(strings.Fields(sb.String()), " "), nil
+}
+
+// Per-field regexes used by bodyFieldParser. Unlike snippetParser, which
+// matches the whole snippet as one fixed sequence, these match independently
+// and tolerate arbitrary text between fields, so they survive the extra
+// markup and varying field order of the full HTML email.
+var (
+	reBodyLocation         = regexp.MustCompile(`([A-Za-z][A-Za-z .'-]*[A-Za-z]),\s*([A-Za-z]{2})\b`)
+	reBodyDate             = regexp.MustCompile(`\b(\d{1,2})/(\d{1,2})/(\d{4})\b`)
+	reBodyTime             = regexp.MustCompile(`(?i)\b(\d{1,2})\s*:\s*(\d{2})\s*([ap]m)\b`)
+	reBodyInstructor       = regexp.MustCompile(`^\s*([A-Za-z]+)`)
+	reBodyZones            = regexp.MustCompile(`(?i)(\d+)\D+(\d+)\D+(\d+)\D+(\d+)\D+(\d+)\s*MINUTES\s*/\s*ZONE`)
+	reBodyCalories         = regexp.MustCompile(`(?i)(\d+)\s*CALORIES\s+BURNED`)
+	reBodySplatPoints      = regexp.MustCompile(`(?i)(\d+)\s*SPLAT\s+POINTS`)
+	reBodyAverageHeartRate = regexp.MustCompile(`(?i)(\d+)\s*AVG\.?\s*HEART-RATE`)
+	reBodyPeakHeartRate    = regexp.MustCompile(`(?i)Peak\s*HR:?\s*(\d+)`)
+)
+
+// reBodyAnchor marks the start of the workout summary table, the same
+// landmark snippetParser anchors on. bodyFieldParser searches only the text
+// from this point on, so boilerplate earlier in the email (addresses,
+// unsubscribe links, a stray date in a footer) can't be mistaken for a field.
+var reBodyAnchor = regexp.MustCompile(`(?i)STUDIO\s+WORKOUT\s+SUMMARY`)
+
+// bodyFieldParser extracts snippet fields from the plain text of a full
+// message body. It returns false if any field could not be found, since a
+// partial workout is not useful to callers.
+func bodyFieldParser(text string) (snippet, bool) {
+	// Real OTF mail has a U+200C (zero-width non-joiner) wedged between the
+	// hour and the colon (see the example in this file's doc comment above
+	// the snippet struct); strip it so reBodyTime can match like it would
+	// against a plain "12:15 PM".
+	text = strings.ReplaceAll(text, "‌", "")
+
+	if loc := reBodyAnchor.FindStringIndex(text); loc != nil {
+		text = text[loc[1]:]
+	}
+
+	location := reBodyLocation.FindStringSubmatch(text)
+	date := reBodyDate.FindStringSubmatch(text)
+	clockIdx := reBodyTime.FindStringSubmatchIndex(text)
+	zones := reBodyZones.FindStringSubmatch(text)
+	calories := reBodyCalories.FindStringSubmatch(text)
+	splatPoints := reBodySplatPoints.FindStringSubmatch(text)
+	averageHeartRate := reBodyAverageHeartRate.FindStringSubmatch(text)
+	peakHeartRate := reBodyPeakHeartRate.FindStringSubmatch(text)
+
+	if location == nil || date == nil || clockIdx == nil || zones == nil ||
+		calories == nil || splatPoints == nil || averageHeartRate == nil || peakHeartRate == nil {
+		return snippet{}, false
+	}
+
+	// There is no "coach:"/"instructor:" label in the real email; the name
+	// simply follows the time directly ("12:15 PM Tiffany"), matching the
+	// field order in the snippet struct above, so extract it positionally
+	// from the text right after the time match instead of from a label.
+	instructor := reBodyInstructor.FindStringSubmatch(text[clockIdx[1]:])
+	if instructor == nil {
+		return snippet{}, false
+	}
+
+	clock := []string{
+		text[clockIdx[0]:clockIdx[1]],
+		text[clockIdx[2]:clockIdx[3]],
+		text[clockIdx[4]:clockIdx[5]],
+		text[clockIdx[6]:clockIdx[7]],
+	}
+
+	return snippet{
+		City:             location[1],
+		State:            location[2],
+		Month:            date[1],
+		Day:              date[2],
+		Year:             date[3],
+		Hour:             clock[1],
+		Minute:           clock[2],
+		AMPM:             strings.ToUpper(clock[3]),
+		Instructor:       instructor[1],
+		Zone1:            zones[1],
+		Zone2:            zones[2],
+		Zone3:            zones[3],
+		Zone4:            zones[4],
+		Zone5:            zones[5],
+		Calories:         calories[1],
+		SplatPoints:      splatPoints[1],
+		AverageHeartRate: averageHeartRate[1],
+		PeakHeartRate:    peakHeartRate[1],
+	}, true
+}
+
+// cache is the on-disk record of previously-parsed workouts, keyed by Gmail
+// message ID, along with the historyId watermark used to fetch only new or
+// changed messages on subsequent runs.
+type cache struct {
+	HistoryID uint64             `json:"history_id"`
+	Snippets  map[string]snippet `json:"snippets"`
+}
+
+// loadCache reads a cache from the given path, returning an empty cache if
+// the file does not exist.
+func loadCache(path string) (*cache, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &cache{Snippets: make(map[string]snippet)}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var c cache
+	if err := json.NewDecoder(f).Decode(&c); err != nil {
+		return nil, err
+	}
+	if c.Snippets == nil {
+		c.Snippets = make(map[string]snippet)
+	}
+	return &c, nil
+}
+
+// saveCache writes a cache to the given path as JSON.
+func saveCache(path string, c *cache) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(c)
+}
+
 // Retrieve a token, saves the token, then returns the generated client.
 func getClient(config *oauth2.Config) *http.Client {
 	// The file token.json stores the user's access and refresh tokens, and is
@@ -82,15 +371,77 @@ func getClient(config *oauth2.Config) *http.Client {
 	return config.Client(context.Background(), tok)
 }
 
-// Request a token from the web, then returns the retrieved token.
+// tokenFromWebTimeout bounds how long we wait for the user to complete the
+// OAuth consent flow in their browser before giving up.
+const tokenFromWebTimeout = 2 * time.Minute
+
+// Request a token from the web, then returns the retrieved token. This binds
+// a local HTTP server to the host/port in config.RedirectURL, opens the
+// consent URL in the user's browser, and receives the authorization code via
+// a /callback handler instead of requiring it to be copy-pasted back into
+// the terminal.
 func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf("Go to the following link in your browser then type the "+
-		"authorization code: \n%v\n", authURL)
+	redirect, err := url.Parse(config.RedirectURL)
+	if err != nil {
+		log.Fatalf("error parsing redirect URL %q: %v", config.RedirectURL, err)
+	}
+	if redirect.Path == "" {
+		redirect.Path = "/"
+	}
+
+	state, err := randomState()
+	if err != nil {
+		log.Fatalf("error generating state parameter: %v", err)
+	}
+
+	codeCh := make(chan string, 1)
+	errCh := make(chan error, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(redirect.Path, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("state"); got != state {
+			http.Error(w, "state mismatch", http.StatusBadRequest)
+			errCh <- fmt.Errorf("state mismatch: got %q, want %q", got, state)
+			return
+		}
+		if errMsg := r.URL.Query().Get("error"); errMsg != "" {
+			http.Error(w, errMsg, http.StatusBadRequest)
+			errCh <- fmt.Errorf("authorization server returned error: %s", errMsg)
+			return
+		}
+
+		code := r.URL.Query().Get("code")
+		if code == "" {
+			http.Error(w, "missing code parameter", http.StatusBadRequest)
+			errCh <- fmt.Errorf("callback request is missing the code parameter")
+			return
+		}
+
+		fmt.Fprintln(w, "Authorization complete, you can close this tab and return to the terminal.")
+		codeCh <- code
+	})
+
+	srv := &http.Server{Addr: redirect.Host, Handler: mux}
+	listener, err := net.Listen("tcp", redirect.Host)
+	if err != nil {
+		log.Fatalf("error binding local callback server to %s: %v", redirect.Host, err)
+	}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	authURL := config.AuthCodeURL(state, oauth2.AccessTypeOffline)
+	fmt.Printf("Opening the following link in your browser to authorize this app:\n%v\n", authURL)
+	if err := openBrowser(authURL); err != nil {
+		fmt.Printf("could not open browser automatically (%v), please open the link manually\n", err)
+	}
 
 	var authCode string
-	if _, err := fmt.Scan(&authCode); err != nil {
-		log.Fatalf("Unable to read authorization code: %v", err)
+	select {
+	case authCode = <-codeCh:
+	case err := <-errCh:
+		log.Fatalf("error during authorization callback: %v", err)
+	case <-time.After(tokenFromWebTimeout):
+		log.Fatalf("timed out after %s waiting for the user to authorize this app", tokenFromWebTimeout)
 	}
 
 	tok, err := config.Exchange(context.TODO(), authCode)
@@ -100,6 +451,27 @@ func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
 	return tok
 }
 
+// randomState generates an unguessable value for the OAuth state parameter.
+func randomState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// openBrowser launches the system's default web browser at the given URL.
+func openBrowser(target string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("open", target).Start()
+	case "windows":
+		return exec.Command("cmd", "/c", "start", target).Start()
+	default:
+		return exec.Command("xdg-open", target).Start()
+	}
+}
+
 // Retrieves a token from a local file.
 func tokenFromFile(file string) (*oauth2.Token, error) {
 	f, err := os.Open(file)
@@ -123,23 +495,202 @@ func saveToken(path string, token *oauth2.Token) {
 	json.NewEncoder(f).Encode(token)
 }
 
+// allMessageIDs returns the IDs of every message matching the query q,
+// paging through Users.Messages.List so results are not limited to the
+// first page.
+func allMessageIDs(ctx context.Context, gm *gmail.Service, q string) ([]string, error) {
+	var ids []string
+	err := gm.Users.Messages.List("me").Q(q).Context(ctx).Pages(ctx, func(resp *gmail.ListMessagesResponse) error {
+		for _, msg := range resp.Messages {
+			ids = append(ids, msg.Id)
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// newMessageIDsSince returns the IDs of messages added to the mailbox since
+// the given historyId, using the Gmail history API so that only new or
+// changed messages need to be re-fetched.
+func newMessageIDsSince(ctx context.Context, gm *gmail.Service, historyID uint64) ([]string, error) {
+	var ids []string
+	err := gm.Users.History.List("me").
+		StartHistoryId(historyID).
+		HistoryTypes("messageAdded").
+		Context(ctx).
+		Pages(ctx, func(resp *gmail.ListHistoryResponse) error {
+			for _, h := range resp.History {
+				for _, added := range h.MessagesAdded {
+					ids = append(ids, added.Message.Id)
+				}
+			}
+			return nil
+		})
+	return ids, err
+}
+
+// messageHeader returns the value of the first header named name on m, or
+// "" if no such header is present.
+func messageHeader(m *gmail.Message, name string) string {
+	if m.Payload == nil {
+		return ""
+	}
+	for _, h := range m.Payload.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// messageFromMatches reports whether m's From header contains from. This is
+// used to filter the results of newMessageIDsSince, since the Gmail history
+// API has no sender filter of its own: Users.History.List only supports
+// HistoryTypes/LabelId/PageToken/StartHistoryId, unlike the query-based
+// Users.Messages.List used for a full resync.
+func messageFromMatches(m *gmail.Message, from string) bool {
+	return strings.Contains(messageHeader(m, "From"), from)
+}
+
+// maxFetchRetries is the number of times a message fetch is retried after a
+// retryable (429/5xx) Gmail API error before giving up.
+const maxFetchRetries = 5
+
+// fetchMessages fetches the given message IDs concurrently, bounded by a
+// semaphore of size concurrency, retrying retryable errors with exponential
+// backoff. Results are collected into a slice indexed by position in ids so
+// that ordering is preserved regardless of which fetch finishes first.
+func fetchMessages(ctx context.Context, gm *gmail.Service, ids []string, concurrency int) ([]*gmail.Message, error) {
+	messages := make([]*gmail.Message, len(ids))
+
+	g, ctx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, concurrency)
+	for i, id := range ids {
+		i, id := i, id
+		sem <- struct{}{}
+		g.Go(func() error {
+			defer func() { <-sem }()
+			m, err := fetchMessageWithRetry(ctx, gm, id)
+			if err != nil {
+				return fmt.Errorf("error fetching email with id %q: %v", id, err)
+			}
+			messages[i] = m
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// fetchMessageWithRetry fetches a single message, retrying with exponential
+// backoff (honoring a Retry-After response header when present) if the
+// Gmail API responds with a 429 or 5xx error.
+func fetchMessageWithRetry(ctx context.Context, gm *gmail.Service, id string) (*gmail.Message, error) {
+	backoff := 500 * time.Millisecond
+
+	var lastErr error
+	for attempt := 0; attempt <= maxFetchRetries; attempt++ {
+		m, err := gm.Users.Messages.Get("me", id).Context(ctx).Do()
+		if err == nil {
+			return m, nil
+		}
+		lastErr = err
+
+		if attempt == maxFetchRetries || !isRetryableGmailError(err) {
+			return nil, err
+		}
+
+		wait := backoff
+		if d, ok := retryAfterDelay(err); ok {
+			wait = d
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+	return nil, lastErr
+}
+
+// isRetryableGmailError reports whether err is a Gmail API error that's
+// worth retrying: rate limiting or a server-side failure.
+func isRetryableGmailError(err error) bool {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return false
+	}
+	return gerr.Code == http.StatusTooManyRequests || gerr.Code >= 500
+}
+
+// isHistoryExpiredError reports whether err is the error Gmail's history API
+// returns when the requested historyId has fallen outside the roughly
+// one-week retention window and its change records are no longer available.
+func isHistoryExpiredError(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusNotFound
+}
+
+// retryAfterDelay extracts the delay requested by a Retry-After response
+// header, if err is a Gmail API error carrying one.
+func retryAfterDelay(err error) (time.Duration, bool) {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return 0, false
+	}
+	retryAfter := gerr.Header.Get("Retry-After")
+	if retryAfter == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(retryAfter); err == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(retryAfter); err == nil {
+		return time.Until(t), true
+	}
+	return 0, false
+}
+
 func main() {
 	ctx := context.Background()
 
 	var args struct {
-		From   string `help:"Sender of Orange Theory data emails"`
-		Output string `arg:"-o"`
+		From        string `help:"Sender of Orange Theory data emails"`
+		Output      string `arg:"-o"`
+		Format      string `arg:"--format" help:"output format: csv or ics"`
+		Sheet       string `arg:"--sheet" help:"Google Sheets spreadsheet ID to append workouts to, instead of writing csv/ics"`
+		SQLite      string `arg:"--sqlite" help:"path to a SQLite database to upsert workouts into, instead of writing csv/ics"`
+		FullResync  bool   `arg:"--full-resync" help:"ignore the cache and re-fetch every matching message"`
+		Since       string `arg:"--since" help:"only fetch messages received after this date (YYYY-MM-DD)"`
+		Concurrency int    `arg:"--concurrency" help:"number of messages to fetch concurrently"`
 	}
 	args.From = "OTbeatReport@orangetheoryfitness.com"
+	args.Format = "csv"
+	args.Concurrency = 8
 	arg.MustParse(&args)
 
+	if args.Sheet == "" && args.SQLite == "" && args.Format != "csv" && args.Format != "ics" {
+		log.Fatalf("invalid --format %q, expected csv or ics", args.Format)
+	}
+	if args.Concurrency <= 0 {
+		log.Fatalf("invalid --concurrency %d, must be greater than 0", args.Concurrency)
+	}
+
 	// load oauth configuration
 	b, err := ioutil.ReadFile("oauth.json")
 	if err != nil {
 		log.Fatalf("error reading client secret file: %v", err)
 	}
 
-	config, err := google.ConfigFromJSON(b, gmail.GmailReadonlyScope)
+	scopes := []string{gmail.GmailReadonlyScope}
+	if args.Sheet != "" {
+		scopes = append(scopes, sheets.SpreadsheetsScope)
+	}
+
+	config, err := google.ConfigFromJSON(b, scopes...)
 	if err != nil {
 		log.Fatalf("error parsing client secret file to config: %v", err)
 	}
@@ -150,52 +701,175 @@ func main() {
 		log.Fatalf("error retrieving Gmail client: %v", err)
 	}
 
-	// search for emails from orangetheory
-	messages, err := gm.Users.Messages.List("me").Q("from:" + args.From).Context(ctx).Do()
-	if err != nil {
-		log.Fatalf("error searching for emails: %v", err)
+	var since time.Time
+	if args.Since != "" {
+		since, err = time.Parse("2006-01-02", args.Since)
+		if err != nil {
+			log.Fatalf("error parsing --since %q, expected format YYYY-MM-DD: %v", args.Since, err)
+		}
 	}
 
-	// parse the emails one-by-one (TODO: parallelize?)
-	var snippets []snippet
-	for _, msg := range messages.Messages {
-		m, err := gm.Users.Messages.Get("me", msg.Id).Context(ctx).Do()
+	// load the cache of previously-parsed workouts, keyed by Gmail message ID
+	const cachePath = "cache.json"
+	var c *cache
+	if args.FullResync {
+		c = &cache{Snippets: make(map[string]snippet)}
+	} else {
+		c, err = loadCache(cachePath)
 		if err != nil {
-			log.Fatalf("error fetching email with id %q': %v", msg.Id, err)
+			log.Fatalf("error loading cache from %s: %v", cachePath, err)
 		}
+	}
+
+	q := "from:" + args.From
+	if !since.IsZero() {
+		q += " after:" + since.Format("2006/01/02")
+	}
+
+	// determine which message IDs we need to fetch: either every message
+	// matching the query (full resync, or no historyId watermark yet), or
+	// just the messages added since the last run according to the Gmail
+	// history API
+	incremental := c.HistoryID != 0 && !args.FullResync
 
-		var snippet snippet
-		matched := snippetParser.Find(&snippet, m.Snippet)
-		if !matched {
-			fmt.Printf("snippet did not match pattern, ignoring: %s\n", m.Snippet)
+	if incremental && !since.IsZero() {
+		log.Fatalf("--since has no effect once a cached historyId exists, because incremental sync only asks Gmail for messages added since that historyId; pass --full-resync to apply --since")
+	}
+
+	var ids []string
+	if incremental {
+		ids, err = newMessageIDsSince(ctx, gm, c.HistoryID)
+		if isHistoryExpiredError(err) {
+			fmt.Printf("historyId %d has expired (Gmail only retains history for about a week), falling back to a full resync\n", c.HistoryID)
+			incremental = false
+			ids, err = allMessageIDs(ctx, gm, q)
+		}
+		if err != nil {
+			log.Fatalf("error listing history since historyId %d: %v", c.HistoryID, err)
+		}
+	} else {
+		ids, err = allMessageIDs(ctx, gm, q)
+		if err != nil {
+			log.Fatalf("error searching for emails: %v", err)
+		}
+	}
+
+	// fetch and parse any messages not already present in the cache, with a
+	// bounded worker pool, preserving order until the final sort below
+	var toFetch []string
+	for _, id := range ids {
+		if _, ok := c.Snippets[id]; !ok {
+			toFetch = append(toFetch, id)
+		}
+	}
+
+	messages, err := fetchMessages(ctx, gm, toFetch, args.Concurrency)
+	if err != nil {
+		log.Fatalf("error fetching emails: %v", err)
+	}
+
+	var parseFailures int
+	for i, id := range toFetch {
+		// Users.History.List has no sender filter, so messages reached via
+		// the incremental path may belong to unrelated mail; skip those
+		// rather than treating them as parse failures.
+		if incremental && !messageFromMatches(messages[i], args.From) {
+			continue
+		}
+
+		s, ok := parseMessage(messages[i])
+		if !ok {
+			parseFailures++
+			fmt.Printf("could not parse workout fields from message %s, ignoring: %s\n", id, messages[i].Snippet)
 			continue
 		}
 
-		snippets = append(snippets, snippet)
+		c.Snippets[id] = s
+	}
+	if parseFailures > 0 {
+		fmt.Printf("failed to parse %d of %d fetched messages\n", parseFailures, len(toFetch))
+	}
+
+	// record the current historyId so the next run can fetch incrementally,
+	// but only once every fetched message has been successfully parsed: if
+	// we advanced the watermark past a message that failed to parse, the
+	// history API would never return that message again and the workout
+	// would be permanently lost. Leaving the watermark in place means the
+	// failed message is re-fetched and retried on the next run.
+	if parseFailures == 0 {
+		profile, err := gm.Users.GetProfile("me").Context(ctx).Do()
+		if err != nil {
+			log.Fatalf("error fetching current historyId: %v", err)
+		}
+		c.HistoryID = profile.HistoryId
+	}
+
+	if err := saveCache(cachePath, c); err != nil {
+		log.Fatalf("error saving cache to %s: %v", cachePath, err)
+	}
+
+	workouts := make([]workout, 0, len(c.Snippets))
+	for id, s := range c.Snippets {
+		workouts = append(workouts, workout{ID: id, snippet: s})
 	}
 
 	// sort by date
-	sort.Slice(snippets, func(i, j int) bool {
-		si := snippets[i]
-		sj := snippets[j]
+	sort.Slice(workouts, func(i, j int) bool {
+		si := workouts[i]
+		sj := workouts[j]
 		di := fmt.Sprintf("%s-%s-%s", si.Year, si.Month, si.Day)
 		dj := fmt.Sprintf("%s-%s-%s", sj.Year, sj.Month, sj.Day)
 		return di < dj
 	})
 
-	// open output file
-	var out io.Writer = os.Stdout
-	if args.Output != "" {
-		f, err := os.Open(args.Output)
+	// pick an exporter based on the flags the user passed
+	var exporter Exporter
+	switch {
+	case args.Sheet != "":
+		sheetsService, err := sheets.NewService(ctx, option.WithHTTPClient(client))
 		if err != nil {
-			log.Fatal("error opening output file:", err)
+			log.Fatalf("error retrieving Sheets client: %v", err)
+		}
+		exporter = &sheetsExporter{service: sheetsService, spreadsheetID: args.Sheet}
+	case args.SQLite != "":
+		exporter = &sqliteExporter{path: args.SQLite}
+	default:
+		// open output file
+		var out io.Writer = os.Stdout
+		if args.Output != "" {
+			f, err := os.OpenFile(args.Output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				log.Fatal("error opening output file:", err)
+			}
+			defer f.Close()
+			out = f
 		}
-		defer f.Close()
-		out = f
+
+		if args.Format == "ics" {
+			exporter = &icsExporter{out: out}
+		} else {
+			exporter = &csvExporter{out: out}
+		}
+	}
+
+	if err := exporter.Export(ctx, workouts); err != nil {
+		log.Fatalf("error exporting workouts: %v", err)
 	}
+}
+
+// Exporter writes a set of parsed workouts to some destination: a file, a
+// Google Sheet, a database, etc.
+type Exporter interface {
+	Export(ctx context.Context, workouts []workout) error
+}
+
+// csvExporter writes workouts as CSV rows.
+type csvExporter struct {
+	out io.Writer
+}
 
-	// write the CSV
-	w := csv.NewWriter(out)
+func (e *csvExporter) Export(ctx context.Context, workouts []workout) error {
+	w := csv.NewWriter(e.out)
 	defer w.Flush()
 
 	w.Write([]string{
@@ -212,19 +886,189 @@ func main() {
 		"Location",
 	})
 
-	for _, s := range snippets {
-		w.Write([]string{
-			fmt.Sprintf("%s/%s/%s", s.Month, s.Day, s.Year),
-			fmt.Sprintf("%s:%s", s.Hour, s.Minute),
-			s.Zone1,
-			s.Zone2,
-			s.Zone3,
-			s.Zone4,
-			s.Zone5,
-			s.Calories,
-			s.AverageHeartRate,
-			s.PeakHeartRate,
-			fmt.Sprintf("%s, %s", s.City, s.State),
-		})
+	for _, s := range workouts {
+		w.Write(workoutRow(s))
+	}
+	return w.Error()
+}
+
+// icsExporter writes workouts as an iCalendar feed, with one VEVENT per
+// workout. Event UIDs are derived from the Gmail message ID so that
+// re-generating the feed produces the same UIDs and can be served as an
+// idempotent, subscribable calendar.
+type icsExporter struct {
+	out io.Writer
+}
+
+func (e *icsExporter) Export(ctx context.Context, workouts []workout) error {
+	cal := ics.NewCalendar()
+
+	for _, wo := range workouts {
+		start, err := wo.startTime()
+		if err != nil {
+			fmt.Printf("could not parse start time for workout %s, skipping from ICS feed: %v\n", wo.ID, err)
+			continue
+		}
+
+		uid := fmt.Sprintf("%x@orangetheory", sha1.Sum([]byte(wo.ID)))
+		event := cal.AddEvent(uid)
+		event.SetStartAt(start)
+		event.SetEndAt(start.Add(60 * time.Minute))
+		event.SetSummary(wo.Instructor)
+		event.SetLocation(fmt.Sprintf("%s, %s", wo.City, wo.State))
+		event.SetDescription(fmt.Sprintf(
+			"Zone minutes: %s/%s/%s/%s/%s\nCalories: %s\nSplat points: %s\nAverage heart rate: %s\nPeak heart rate: %s",
+			wo.Zone1, wo.Zone2, wo.Zone3, wo.Zone4, wo.Zone5,
+			wo.Calories, wo.SplatPoints, wo.AverageHeartRate, wo.PeakHeartRate,
+		))
+	}
+
+	return cal.SerializeTo(e.out)
+}
+
+// workoutKey returns the key used to detect whether a workout has already
+// been exported: the combination of date, time and location is unique per
+// workout and stable across runs.
+func workoutKey(w workout) string {
+	return fmt.Sprintf("%s/%s/%s|%s:%s|%s, %s", w.Month, w.Day, w.Year, w.Hour, w.Minute, w.City, w.State)
+}
+
+// workoutRow renders a workout as the row of fields shared by the CSV and
+// Sheets exporters.
+func workoutRow(w workout) []string {
+	return []string{
+		fmt.Sprintf("%s/%s/%s", w.Month, w.Day, w.Year),
+		fmt.Sprintf("%s:%s", w.Hour, w.Minute),
+		w.Zone1,
+		w.Zone2,
+		w.Zone3,
+		w.Zone4,
+		w.Zone5,
+		w.Calories,
+		w.AverageHeartRate,
+		w.PeakHeartRate,
+		fmt.Sprintf("%s, %s", w.City, w.State),
+	}
+}
+
+// sheetsExporter appends workouts as rows to a Google Sheet, skipping any
+// rows whose date+time+location already appear in the sheet so re-running
+// doesn't duplicate workouts already present.
+type sheetsExporter struct {
+	service       *sheets.Service
+	spreadsheetID string
+}
+
+func (e *sheetsExporter) Export(ctx context.Context, workouts []workout) error {
+	const headerRange = "A1:K1"
+	const dataRange = "A2:K"
+
+	header := []string{
+		"Date", "Time", "Zone 1", "Zone 2", "Zone 3", "Zone 4", "Zone 5",
+		"Calories", "Average Heart Rate", "Peak Heart Rate", "Location",
+	}
+
+	existingRows, err := e.service.Spreadsheets.Values.Get(e.spreadsheetID, dataRange).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("error reading existing rows from spreadsheet %q: %v", e.spreadsheetID, err)
+	}
+
+	existing := make(map[string]bool, len(existingRows.Values))
+	for _, row := range existingRows.Values {
+		if len(row) < 11 {
+			continue
+		}
+		existing[fmt.Sprintf("%v|%v|%v", row[0], row[1], row[10])] = true
+	}
+
+	if len(existingRows.Values) == 0 {
+		headerValues := &sheets.ValueRange{Values: [][]interface{}{stringsToInterfaces(header)}}
+		if _, err := e.service.Spreadsheets.Values.Update(e.spreadsheetID, headerRange, headerValues).
+			ValueInputOption("RAW").Context(ctx).Do(); err != nil {
+			return fmt.Errorf("error writing header row to spreadsheet %q: %v", e.spreadsheetID, err)
+		}
+	}
+
+	var rows [][]interface{}
+	for _, wo := range workouts {
+		if existing[workoutKey(wo)] {
+			continue
+		}
+		rows = append(rows, stringsToInterfaces(workoutRow(wo)))
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	_, err = e.service.Spreadsheets.Values.Append(e.spreadsheetID, dataRange, &sheets.ValueRange{Values: rows}).
+		ValueInputOption("RAW").Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("error appending rows to spreadsheet %q: %v", e.spreadsheetID, err)
+	}
+	return nil
+}
+
+func stringsToInterfaces(ss []string) []interface{} {
+	vs := make([]interface{}, len(ss))
+	for i, s := range ss {
+		vs[i] = s
+	}
+	return vs
+}
+
+// sqliteExporter upserts workouts into a `workouts` table in a SQLite
+// database, using a UNIQUE constraint on date+time+location so re-running
+// the export does not duplicate rows.
+type sqliteExporter struct {
+	path string
+}
+
+func (e *sqliteExporter) Export(ctx context.Context, workouts []workout) error {
+	db, err := sql.Open("sqlite3", e.path)
+	if err != nil {
+		return fmt.Errorf("error opening SQLite database %q: %v", e.path, err)
+	}
+	defer db.Close()
+
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS workouts (
+			date text NOT NULL,
+			time text NOT NULL,
+			zone1 integer,
+			zone2 integer,
+			zone3 integer,
+			zone4 integer,
+			zone5 integer,
+			calories integer,
+			average_heart_rate integer,
+			peak_heart_rate integer,
+			location text NOT NULL,
+			UNIQUE(date, time, location)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating workouts table: %v", err)
+	}
+
+	stmt, err := db.PrepareContext(ctx, `
+		INSERT OR IGNORE INTO workouts
+			(date, time, zone1, zone2, zone3, zone4, zone5, calories, average_heart_rate, peak_heart_rate, location)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return fmt.Errorf("error preparing insert statement: %v", err)
+	}
+	defer stmt.Close()
+
+	for _, wo := range workouts {
+		row := workoutRow(wo)
+		args := make([]interface{}, len(row))
+		for i, v := range row {
+			args[i] = v
+		}
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			return fmt.Errorf("error inserting workout %s: %v", wo.ID, err)
+		}
 	}
+	return nil
 }
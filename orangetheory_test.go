@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+// exampleSnippetText is the example snippet documented above the snippet
+// struct, including the U+200C (zero-width non-joiner) that real OTF mail
+// wedges between the hour and the colon.
+const exampleSnippetText = "STUDIO WORKOUT SUMMARY Bothell, WA 06/13/2021 12‌:15 PM Tiffany 15 0 0 0 0 MINUTES / ZONE 55 CALORIES BURNED 0 SPLAT POINTS 75 AVG. HEART-RATE Peak HR: 80"
+
+func TestBodyFieldParser(t *testing.T) {
+	want := snippet{
+		City:             "Bothell",
+		State:            "WA",
+		Month:            "06",
+		Day:              "13",
+		Year:             "2021",
+		Hour:             "12",
+		Minute:           "15",
+		AMPM:             "PM",
+		Instructor:       "Tiffany",
+		Zone1:            "15",
+		Zone2:            "0",
+		Zone3:            "0",
+		Zone4:            "0",
+		Zone5:            "0",
+		Calories:         "55",
+		SplatPoints:      "0",
+		AverageHeartRate: "75",
+		PeakHeartRate:    "80",
+	}
+
+	got, ok := bodyFieldParser(exampleSnippetText)
+	if !ok {
+		t.Fatalf("bodyFieldParser returned false for the documented example snippet")
+	}
+	if got != want {
+		t.Errorf("bodyFieldParser(%q) = %+v, want %+v", exampleSnippetText, got, want)
+	}
+}
+
+// TestBodyFieldParserMissingField checks that a snippet missing a required
+// field (here, the SPLAT POINTS count) is rejected rather than returning a
+// partially-populated workout.
+func TestBodyFieldParserMissingField(t *testing.T) {
+	text := "STUDIO WORKOUT SUMMARY Bothell, WA 06/13/2021 12:15 PM Tiffany 15 0 0 0 0 MINUTES / ZONE 55 CALORIES BURNED AVG. HEART-RATE Peak HR: 80"
+
+	if _, ok := bodyFieldParser(text); ok {
+		t.Errorf("bodyFieldParser(%q) returned true, want false for a missing splat points field", text)
+	}
+}